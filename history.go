@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// HistoryStore persists chat messages per room and recalls them for
+// reconnecting clients. Implementations must be safe for concurrent use.
+// The Hub itself calls Append and Recent only from Hub.run's goroutine.
+type HistoryStore interface {
+	// Append records msg as the newest message in room.
+	Append(room string, msg Message) error
+	// Recent returns up to n messages from room, oldest first. If before is
+	// non-zero, only messages recorded strictly before that time are
+	// considered — this lets a client page further back than the most
+	// recent n.
+	Recent(room string, n int, before time.Time) ([]Message, error)
+}
+
+// newHistoryStore builds the HistoryStore selected by cfg.HistoryBackend.
+func newHistoryStore(cfg ServerConfig) (HistoryStore, error) {
+	switch cfg.HistoryBackend {
+	case "", "memory":
+		return newMemoryHistoryStore(), nil
+	case "bolt":
+		return newBoltHistoryStore(cfg.HistoryDBPath)
+	default:
+		return nil, fmt.Errorf("unknown history backend %q", cfg.HistoryBackend)
+	}
+}
+
+// historyEntry pairs a persisted message with when it was recorded, so
+// Recent can honour the "before" cursor.
+type historyEntry struct {
+	msg  Message
+	sent time.Time
+}
+
+// memoryHistoryStore is the default HistoryStore: an in-memory ring per
+// room, capped at MaxHistoryLimit entries like boltHistoryStore, so ?limit=
+// means the same thing regardless of which backend is active. It does not
+// survive a restart.
+type memoryHistoryStore struct {
+	mu      sync.Mutex
+	history map[string][]historyEntry
+}
+
+func newMemoryHistoryStore() *memoryHistoryStore {
+	return &memoryHistoryStore{history: make(map[string][]historyEntry)}
+}
+
+func (s *memoryHistoryStore) Append(room string, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := append(s.history[room], historyEntry{msg: msg, sent: time.Now()})
+	if len(entries) > MaxHistoryLimit {
+		entries = entries[len(entries)-MaxHistoryLimit:]
+	}
+	s.history[room] = entries
+	return nil
+}
+
+func (s *memoryHistoryStore) Recent(room string, n int, before time.Time) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.history[room]
+	out := make([]Message, 0, n)
+	for i := len(entries) - 1; i >= 0 && len(out) < n; i-- {
+		if !before.IsZero() && !entries[i].sent.Before(before) {
+			continue
+		}
+		out = append(out, entries[i].msg)
+	}
+	reverseMessages(out)
+	return out, nil
+}
+
+// reverseMessages reverses msgs in place, turning a newest-first slice into
+// the oldest-first order clients expect.
+func reverseMessages(msgs []Message) {
+	for l, r := 0, len(msgs)-1; l < r; l, r = l+1, r-1 {
+		msgs[l], msgs[r] = msgs[r], msgs[l]
+	}
+}
+
+// boltHistoryStore persists chat history in a BoltDB file so it survives
+// process restarts. Each room gets its own bucket; keys are the UnixNano
+// timestamp of the message, which keeps them ordered for Cursor iteration.
+type boltHistoryStore struct {
+	db *bolt.DB
+}
+
+func newBoltHistoryStore(path string) (*boltHistoryStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltHistoryStore{db: db}, nil
+}
+
+// Close releases the underlying BoltDB file. Safe to defer from main.
+func (s *boltHistoryStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltHistoryStore) Append(room string, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(room))
+		if err != nil {
+			return err
+		}
+		key := timeKey(time.Now())
+		// Guarantee key uniqueness even if two messages land in the same
+		// nanosecond by bumping until we find a free slot.
+		for bucket.Get(key) != nil {
+			key = nextKey(key)
+		}
+		if err := bucket.Put(key, data); err != nil {
+			return err
+		}
+		return trimBucket(bucket, MaxHistoryLimit)
+	})
+}
+
+// trimBucket drops the oldest entries from bucket until at most max remain,
+// so a room's persisted history can't grow without bound the way the
+// in-memory store's ring buffer already doesn't.
+//
+// bucket.Stats().KeyN walks the already-spilled page tree, so it doesn't see
+// nodes still staged in-memory by the current read-write transaction and
+// undercounts by however many keys that transaction has put — counting via
+// the cursor instead sees the transaction's own writes and gets this right.
+func trimBucket(bucket *bolt.Bucket, max int) error {
+	cursor := bucket.Cursor()
+
+	n := 0
+	for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+		n++
+	}
+	if n <= max {
+		return nil
+	}
+
+	// After Delete the cursor already sits on the following key, so Next
+	// would skip it; re-read First instead to keep dropping the oldest.
+	for k, _ := cursor.First(); k != nil && n > max; k, _ = cursor.First() {
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+		n--
+	}
+	return nil
+}
+
+func (s *boltHistoryStore) Recent(room string, n int, before time.Time) ([]Message, error) {
+	var out []Message
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(room))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+
+		var k, v []byte
+		if before.IsZero() {
+			k, v = cursor.Last()
+		} else {
+			cursor.Seek(timeKey(before))
+			k, v = cursor.Prev()
+		}
+
+		for ; k != nil && len(out) < n; k, v = cursor.Prev() {
+			var msg Message
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			out = append(out, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reverseMessages(out)
+	return out, nil
+}
+
+// timeKey encodes t as a big-endian byte slice so BoltDB's byte-lexical key
+// ordering matches chronological order.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// nextKey returns the key immediately after k in byte-lexical order.
+func nextKey(k []byte) []byte {
+	next := make([]byte, 8)
+	binary.BigEndian.PutUint64(next, binary.BigEndian.Uint64(k)+1)
+	return next
+}
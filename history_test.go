@@ -0,0 +1,117 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testHistoryStores returns a fresh instance of every HistoryStore
+// implementation, keyed by backend name, so the tests below hold both
+// backends to the same contract.
+func testHistoryStores(t *testing.T) map[string]HistoryStore {
+	t.Helper()
+
+	boltStore, err := newBoltHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("newBoltHistoryStore: %v", err)
+	}
+	t.Cleanup(func() { boltStore.Close() })
+
+	return map[string]HistoryStore{
+		"memory": newMemoryHistoryStore(),
+		"bolt":   boltStore,
+	}
+}
+
+func TestHistoryStoreAppendRecent(t *testing.T) {
+	for name, store := range testHistoryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				msg := Message{Type: ChatMessage, Payload: i}
+				if err := store.Append("#all", msg); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+
+			msgs, err := store.Recent("#all", 10, time.Time{})
+			if err != nil {
+				t.Fatalf("Recent: %v", err)
+			}
+			if len(msgs) != 3 {
+				t.Fatalf("got %d messages, want 3", len(msgs))
+			}
+			// Oldest first.
+			for i, msg := range msgs {
+				payload, ok := msg.Payload.(float64) // round-tripped through bolt as JSON
+				if !ok {
+					if n, ok := msg.Payload.(int); ok {
+						payload = float64(n)
+					} else {
+						t.Fatalf("unexpected payload type %T", msg.Payload)
+					}
+				}
+				if int(payload) != i {
+					t.Fatalf("msgs[%d].Payload = %v, want %d", i, msg.Payload, i)
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryStoreRecentRespectsLimit(t *testing.T) {
+	for name, store := range testHistoryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 5; i++ {
+				if err := store.Append("#all", Message{Type: ChatMessage, Payload: i}); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+
+			msgs, err := store.Recent("#all", 2, time.Time{})
+			if err != nil {
+				t.Fatalf("Recent: %v", err)
+			}
+			if len(msgs) != 2 {
+				t.Fatalf("got %d messages, want 2", len(msgs))
+			}
+		})
+	}
+}
+
+func TestHistoryStoreRecentEmptyRoom(t *testing.T) {
+	for name, store := range testHistoryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			msgs, err := store.Recent("#nobody-here", 10, time.Time{})
+			if err != nil {
+				t.Fatalf("Recent: %v", err)
+			}
+			if len(msgs) != 0 {
+				t.Fatalf("got %d messages, want 0", len(msgs))
+			}
+		})
+	}
+}
+
+// TestHistoryStoreTrimsToMaxHistoryLimit confirms every backend retains the
+// same amount of history, so a client's ?limit= means the same thing
+// regardless of which -history-backend is active.
+func TestHistoryStoreTrimsToMaxHistoryLimit(t *testing.T) {
+	for name, store := range testHistoryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < MaxHistoryLimit+10; i++ {
+				if err := store.Append("#all", Message{Type: ChatMessage, Payload: i}); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+
+			msgs, err := store.Recent("#all", MaxHistoryLimit+10, time.Time{})
+			if err != nil {
+				t.Fatalf("Recent: %v", err)
+			}
+			if len(msgs) != MaxHistoryLimit {
+				t.Fatalf("got %d persisted messages, want capped at %d", len(msgs), MaxHistoryLimit)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient builds a Client with no real *websocket.Conn, matching how
+// serveChat constructs one, since Hub.run never touches client.conn itself.
+func newTestClient(name string) *Client {
+	return &Client{
+		name:  name,
+		send:  make(chan Message, 256),
+		rooms: make(map[string]bool),
+	}
+}
+
+// drain reads and discards every Message sent to client.send until it is
+// closed, so broadcast/announcement goroutines can't fill the buffer out
+// from under a concurrent test. It must not be used on a client the test
+// still needs to synchronize on — see flushHub.
+func drain(client *Client) {
+	go func() {
+		for range client.send {
+		}
+	}()
+}
+
+// flushHub blocks until every register/unregister/broadcast already sent to
+// h has been fully processed by Hub.run, including the goroutine-free parts
+// of each case body (map deletes, etc.), not just the channel rendezvous.
+//
+// A bare channel send completing only proves Hub.run received the value —
+// the Go memory model gives no guarantee that the rest of that case's body
+// has run by the time the sender's send statement returns. So instead of
+// assuming that, flushHub registers a throwaway client, requests its room
+// list, and synchronously reads the roomList frame back off its own send
+// channel: since Hub.run processes one case body to completion before ever
+// looping back to select, that frame can only be sent after everything
+// queued ahead of it (including the preceding unregisters this test cares
+// about) has finished, and receiving it gives the test goroutine a real
+// happens-before edge into hub-owned state.
+func flushHub(t *testing.T, h *Hub) {
+	t.Helper()
+
+	sentinel := newTestClient("flush-sentinel")
+	h.register <- membership{client: sentinel, room: "#all", limit: 0}
+	h.roomListReq <- sentinel
+
+	for {
+		select {
+		case msg := <-sentinel.send:
+			if msg.Type == RoomList {
+				h.unregister <- sentinel
+				// Hub.run closes sentinel.send only after removing it from
+				// h.clients and h.byName, so waiting for the close keeps the
+				// sentinel itself out of the state the caller inspects.
+				for range sentinel.send {
+				}
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for flush sentinel's roomList frame")
+		}
+	}
+}
+
+// TestHubConcurrentRegisterBroadcastUnregister exercises the exact pattern
+// the maintainer reproduced a data race in: many clients joining the same
+// room, broadcasting, and disconnecting at once. Run with -race to confirm
+// subscribe/unsubscribe/broadcastUserCount/broadcastSystem no longer touch
+// room.clients outside Hub.run's own goroutine.
+func TestHubConcurrentRegisterBroadcastUnregister(t *testing.T) {
+	h := newHub(newMemoryHistoryStore())
+	go h.run()
+
+	const n = 50
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = newTestClient(fmt.Sprintf("user%d", i))
+		drain(clients[i])
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			h.register <- membership{client: c, room: "#all", limit: 0}
+			h.broadcast <- roomMessage{room: "#all", msg: Message{Type: ChatMessage, Payload: c.name}}
+		}(c)
+	}
+	wg.Wait()
+
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			h.unregister <- c
+		}(c)
+	}
+	wg.Wait()
+
+	flushHub(t, h)
+
+	if len(h.clients) != 0 {
+		t.Fatalf("h.clients not empty after all clients unregistered: %d left", len(h.clients))
+	}
+	if len(h.byName) != 0 {
+		t.Fatalf("h.byName not empty after all clients unregistered: %d left", len(h.byName))
+	}
+}
+
+// TestHubEvictOnDuplicateLogin confirms that registering a second client
+// under a name already in byName kicks the older connection: its send
+// channel is closed and it is dropped from the room it was in, with the
+// newer connection taking its place.
+func TestHubEvictOnDuplicateLogin(t *testing.T) {
+	h := newHub(newMemoryHistoryStore())
+	go h.run()
+
+	first := newTestClient("dup")
+	h.register <- membership{client: first, room: "#all", limit: 0}
+
+	second := newTestClient("dup")
+	drain(second)
+	h.register <- membership{client: second, room: "#all", limit: 0}
+
+	closed := false
+	for !closed {
+		select {
+		case _, ok := <-first.send:
+			closed = !ok
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for evicted client's send channel to close")
+		}
+	}
+
+	flushHub(t, h)
+
+	if h.byName["dup"] != second {
+		t.Fatalf("byName[\"dup\"] = %v, want the second connection", h.byName["dup"])
+	}
+	if h.rooms["#all"].clients[first] {
+		t.Fatal("evicted connection is still subscribed to #all")
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"compress/flate"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,17 +19,41 @@ import (
 // Every WebSocket frame carries a "type" field that tells the receiver
 // how to interpret the "payload" field.
 const (
-	System      = "system"      // Server-generated announcements (e.g. "alice joined")
-	UserCount   = "userCount"   // Current connected-user count
-	ChatMessage = "chatMessage" // Ordinary user chat message
-	DateFormat  = "150405"      // Go time layout – HHmmss, used for anon names
-	MaxHistory  = 100           // Maximum chat messages kept in memory
+	System        = "system"        // Server-generated announcements (e.g. "alice joined")
+	UserCount     = "userCount"     // Current connected-user count (per room)
+	ChatMessage   = "chatMessage"   // Ordinary user chat message
+	Join          = "join"          // Client request to subscribe to a room
+	Leave         = "leave"         // Client request to unsubscribe from a room
+	RoomList      = "roomList"      // List of rooms the client currently belongs to
+	DirectMessage = "directMessage" // Private message routed to a single recipient by name
+	DateFormat    = "150405"        // Go time layout – HHmmss, used for anon names
+	MaxHistory    = 100             // Default history replay depth on join, when ?limit= is unset
+	DefaultRoom   = "#all"          // Room used when /chat is opened without ?room=, gorilla-chat style
+
+	MaxHistoryLimit = 1000 // Upper bound on ?limit=, and how much history each HistoryStore backend retains per room
 )
 
+// Keepalive tuning, gorilla-chat style: the server pings every pingPeriod
+// and expects a pong within pongWait, or the connection is considered dead.
+// pingPeriod must stay comfortably below pongWait so pings arrive before the
+// read deadline expires.
+const (
+	writeWait      = 10 * time.Second    // time allowed to write a message to the peer
+	pongWait       = 60 * time.Second    // time allowed to read the next pong from the peer
+	pingPeriod     = (pongWait * 9) / 10 // send pings at this period; must be less than pongWait
+	maxMessageSize = 512                 // maximum message size allowed from a peer, in bytes
+)
+
+// tokenTTL bounds how long an issued /login token may sit unused before it
+// expires. It's deliberately short: the client is expected to redeem it
+// against /chat within a couple of page loads.
+const tokenTTL = 30 * time.Second
+
 // Message is the universal JSON envelope for every frame sent and received.
 //
-//	Client - Server:  { "type": "chatMessage", "payload": { "username": "…", "message": "…" } }
-//	Server - Client:  same shape, plus system / userCount frames
+//	Client - Server:  { "type": "chatMessage", "payload": { "room": "…", "username": "…", "message": "…" } }
+//	Client - Server:  { "type": "directMessage", "payload": { "to": "…", "message": "…" } }
+//	Server - Client:  same shapes, plus system / userCount / roomList frames
 type Message struct {
 	Type    string `json:"type"`
 	Payload any    `json:"payload"`
@@ -31,34 +61,274 @@ type Message struct {
 
 // Client represents a single connected WebSocket session.
 type Client struct {
-	conn *websocket.Conn // live WebSocket connection
-	send chan Message    // outbound queue (buffered 256); closed by hub on disconnect
-	name string          // resolved username (prompt value or Anon_HHmmss)
+	conn  *websocket.Conn // live WebSocket connection
+	send  chan Message    // outbound queue (buffered 256); closed by hub on disconnect
+	name  string          // resolved username (prompt value or Anon_HHmmss)
+	rooms map[string]bool // rooms this client currently subscribes to; owned by Hub.run
+}
+
+// Room is a single named channel: just its own subscriber set. History lives
+// in the Hub's HistoryStore, not here, so it survives a room being emptied
+// and recreated. All fields are owned by Hub.run and must only be touched
+// there.
+type Room struct {
+	name    string
+	clients map[*Client]bool
+}
+
+// tokenEntry is a single outstanding one-time token minted by /login.
+type tokenEntry struct {
+	username string
+	expires  time.Time
+}
+
+// TokenStore issues and redeems short-lived, single-use tokens that bind a
+// WebSocket upgrade to a previously-authenticated username, similar to the
+// TokensRepo/WsRTMStartParams handshake in the lets-go-chat reference server.
+type TokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]tokenEntry
 }
 
-// Hub is the single-goroutine event loop that owns all shared state.
+// newTokenStore allocates an empty, ready-to-use token store.
+func newTokenStore() *TokenStore {
+	return &TokenStore{tokens: make(map[string]tokenEntry)}
+}
+
+// Issue mints a new one-time token bound to username, valid for tokenTTL.
+func (s *TokenStore) Issue(username string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token] = tokenEntry{username: username, expires: time.Now().Add(tokenTTL)}
+	return token, nil
+}
+
+// Consume redeems token exactly once: a second call with the same token, or
+// a call after tokenTTL has elapsed, returns ok=false.
+func (s *TokenStore) Consume(token string) (username string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, found := s.tokens[token]
+	delete(s.tokens, token) // single-use: valid or not, it's gone now
+	if !found || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.username, true
+}
+
+// anonName produces a fallback username of the form Anon_HHmmss.
+func anonName() string {
+	var sb strings.Builder
+	sb.WriteString("Anon_")
+	sb.WriteString(time.Now().Format(DateFormat))
+	return sb.String()
+}
+
+// membership is sent over Hub.register/Hub.join/Hub.leave to add or remove a
+// client from a room. limit is only meaningful on Hub.register — it's the
+// caller-requested history depth (0 means "use the default").
+type membership struct {
+	client *Client
+	room   string
+	limit  int
+}
+
+// roomMessage pairs an inbound chat frame with the room it should be
+// delivered to.
+type roomMessage struct {
+	room string
+	msg  Message
+}
+
+// directMessage is a private, one-to-one chat frame to be routed by
+// recipient name rather than fanned out to a room.
+type directMessage struct {
+	from *Client
+	to   string
+	text string
+}
+
+// Hub is the single-goroutine event loop that owns all shared state. It acts
+// as a router: every room is independent, keyed by name.
 type Hub struct {
-	clients    map[*Client]bool // set of active connections
-	broadcast  chan Message     // messages to send-out to all clients
-	register   chan *Client     // new connection arrivals
-	unregister chan *Client     // disconnecting clients
-	history    []Message        // set of last previous chat messages limited by MaxHistory
+	clients     map[*Client]bool   // every live connection, regardless of room membership
+	byName      map[string]*Client // resolved username -> its current connection
+	rooms       map[string]*Room   // all known rooms, keyed by name
+	store       HistoryStore       // persists/recalls chat history per room
+	broadcast   chan roomMessage   // messages to fan-out to a room's subscribers
+	direct      chan directMessage // private messages routed by recipient name
+	register    chan membership    // new connection joining its initial room
+	unregister  chan *Client       // disconnecting clients (removed from every room)
+	join        chan membership    // client requests to subscribe to an additional room
+	leave       chan membership    // client requests to unsubscribe from a room
+	roomListReq chan *Client       // client requests its current room list
 }
 
-var upgrader = websocket.Upgrader{
-	// Allow connections from any origin for now. If prod, please change.
-	CheckOrigin: func(r *http.Request) bool { return true },
+// ServerConfig holds the tunables for the WebSocket upgrader and listener.
+// Populated from command-line flags in main; see loadConfig.
+type ServerConfig struct {
+	Addr              string        // HTTP listen address
+	ReadBufferSize    int           // websocket.Upgrader.ReadBufferSize
+	WriteBufferSize   int           // websocket.Upgrader.WriteBufferSize
+	HandshakeTimeout  time.Duration // websocket.Upgrader.HandshakeTimeout
+	Subprotocols      []string      // websocket.Upgrader.Subprotocols
+	AllowedOrigins    []string      // exact Origin header matches; "*" opts into allow-all
+	EnableCompression bool          // permessage-deflate (RFC 7692)
+	HistoryBackend    string        // "memory" (default) or "bolt"
+	HistoryDBPath     string        // file path used by the "bolt" backend
 }
 
-// newHub allocates all channels and the client set.
-// history is nil until the first message arrives (lazy alloc).
-func newHub() *Hub {
+// loadConfig parses server tunables from command-line flags.
+func loadConfig() ServerConfig {
+	addr := flag.String("addr", ":8080", "HTTP listen address")
+	readBuf := flag.Int("read-buffer-size", 1024, "WebSocket read buffer size, in bytes")
+	writeBuf := flag.Int("write-buffer-size", 1024, "WebSocket write buffer size, in bytes")
+	handshakeTimeout := flag.Duration("handshake-timeout", 10*time.Second, "WebSocket upgrade handshake timeout")
+	subprotocols := flag.String("subprotocols", "", "comma-separated list of accepted WebSocket subprotocols")
+	origins := flag.String("allowed-origins", "", `comma-separated list of allowed Origin headers; use "*" to (unsafely) allow all`)
+	compression := flag.Bool("enable-compression", true, "enable permessage-deflate compression")
+	historyBackend := flag.String("history-backend", "memory", `chat history store: "memory" or "bolt"`)
+	historyDBPath := flag.String("history-db-path", "hallway_history.db", `BoltDB file path, used when -history-backend=bolt`)
+	flag.Parse()
+
+	return ServerConfig{
+		Addr:              *addr,
+		ReadBufferSize:    *readBuf,
+		WriteBufferSize:   *writeBuf,
+		HandshakeTimeout:  *handshakeTimeout,
+		Subprotocols:      splitCSV(*subprotocols),
+		AllowedOrigins:    splitCSV(*origins),
+		EnableCompression: *compression,
+		HistoryBackend:    *historyBackend,
+		HistoryDBPath:     *historyDBPath,
+	}
+}
+
+// splitCSV trims and splits a comma-separated flag value, dropping empty
+// entries. An empty input yields a nil slice.
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// newUpgrader builds a websocket.Upgrader from cfg. CheckOrigin accepts
+// requests without an Origin header, and otherwise rejects every origin
+// (same-origin included) unless cfg.AllowedOrigins explicitly lists it, or
+// contains "*" to opt into allowing every origin.
+func newUpgrader(cfg ServerConfig) websocket.Upgrader {
+	allowAll := false
+	allowed := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, o := range cfg.AllowedOrigins {
+		if o == "*" {
+			allowAll = true
+			continue
+		}
+		allowed[o] = true
+	}
+
+	return websocket.Upgrader{
+		ReadBufferSize:    cfg.ReadBufferSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+		HandshakeTimeout:  cfg.HandshakeTimeout,
+		Subprotocols:      cfg.Subprotocols,
+		EnableCompression: cfg.EnableCompression,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true // non-browser clients don't send an Origin header
+			}
+			return allowAll || allowed[origin]
+		},
+	}
+}
+
+// newHub allocates all channels and the room set. store is used to persist
+// and recall chat history; pass a newMemoryHistoryStore() for the previous
+// in-process-only behaviour.
+func newHub(store HistoryStore) *Hub {
 	return &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan Message),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+		clients:     make(map[*Client]bool),
+		byName:      make(map[string]*Client),
+		rooms:       make(map[string]*Room),
+		store:       store,
+		broadcast:   make(chan roomMessage),
+		direct:      make(chan directMessage),
+		register:    make(chan membership),
+		unregister:  make(chan *Client),
+		join:        make(chan membership),
+		leave:       make(chan membership),
+		roomListReq: make(chan *Client),
+	}
+}
+
+// getOrCreateRoom returns the named room, allocating it on first use.
+// Must only be called from Hub.run.
+func (h *Hub) getOrCreateRoom(name string) *Room {
+	room, ok := h.rooms[name]
+	if !ok {
+		room = &Room{name: name, clients: make(map[*Client]bool)}
+		h.rooms[name] = room
+	}
+	return room
+}
+
+// subscribe adds client to room, replays the room's history to it, and
+// announces the join. Must only be called from Hub.run.
+func (h *Hub) subscribe(client *Client, roomName string, limit int) {
+	h.clients[client] = true
+
+	room := h.getOrCreateRoom(roomName)
+	if room.clients[client] {
+		return
+	}
+	room.clients[client] = true
+	client.rooms[roomName] = true
+
+	if limit <= 0 {
+		limit = MaxHistory
+	}
+	msgs, err := h.store.Recent(roomName, limit, time.Time{})
+	if err != nil {
+		log.Println("history lookup error:", err)
 	}
+	for _, msg := range msgs {
+		h.send(client, msg)
+	}
+
+	// count is captured synchronously here, in Hub.run's goroutine, so the
+	// spawned goroutine below never touches room.clients itself.
+	go h.broadcastUserCount(roomName, len(room.clients))
+	go h.broadcastSystem(roomName, client.name+" joined "+roomName)
+}
+
+// unsubscribe removes client from room and announces the departure. Must
+// only be called from Hub.run.
+func (h *Hub) unsubscribe(client *Client, roomName string) {
+	room, ok := h.rooms[roomName]
+	if !ok || !room.clients[client] {
+		return
+	}
+	delete(room.clients, client)
+	delete(client.rooms, roomName)
+
+	go h.broadcastUserCount(roomName, len(room.clients))
+	go h.broadcastSystem(roomName, client.name+" left "+roomName)
 }
 
 // run is the heart of the server. It must be started in its own goroutine.
@@ -66,64 +336,156 @@ func (h *Hub) run() {
 	for {
 		select {
 
-		// ── New client connected ───
-		case client := <-h.register:
-			h.clients[client] = true
-
-			// Replay chat history so the new joiner sees recent context.
-			for _, msg := range h.history {
-				client.send <- msg
+		// ── New client connected; join its initial room ───
+		case m := <-h.register:
+			// Only one live connection per identity: kick the older one.
+			// This also keeps names unique, which is what makes byName a
+			// valid routing table for direct messages.
+			if old, ok := h.byName[m.client.name]; ok {
+				h.evict(old, "replaced by a new connection for "+old.name)
 			}
+			h.byName[m.client.name] = m.client
+			h.subscribe(m.client, m.room, m.limit)
 
-			go h.broadcastUserCount()
-			go h.broadcastSystem(client.name + " joined")
-
-		// ── Client disconnected ───
+		// ── Client disconnected; drop it from every room it was in ───
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
+			if h.clients[client] { // already evicted (slow consumer or replaced login) otherwise
+				for roomName := range client.rooms {
+					h.unsubscribe(client, roomName)
+				}
 				delete(h.clients, client)
+				if h.byName[client.name] == client {
+					delete(h.byName, client.name)
+				}
 				close(client.send) // signals writePump to exit
-				go h.broadcastUserCount()
-				go h.broadcastSystem(client.name + " left")
 			}
 
-		// ── send-out an inbound message to everyone ──
-		case message := <-h.broadcast:
+		// ── Client requests to subscribe to another room ───
+		case m := <-h.join:
+			if h.clients[m.client] { // an evicted client's send channel is already closed
+				h.subscribe(m.client, m.room, 0)
+			}
+
+		// ── Client requests to leave a room ───
+		case m := <-h.leave:
+			h.unsubscribe(m.client, m.room)
+
+		// ── Client asks which rooms it currently belongs to ───
+		case client := <-h.roomListReq:
+			names := make([]string, 0, len(client.rooms))
+			for name := range client.rooms {
+				names = append(names, name)
+			}
+			h.send(client, Message{Type: RoomList, Payload: map[string][]string{"rooms": names}})
+
+		// ── send-out an inbound message to everyone in its room ──
+		case rm := <-h.broadcast:
+			room := h.getOrCreateRoom(rm.room)
+
 			// Only persist chat messages; ignore system/count frames.
-			if message.Type == ChatMessage {
-				h.history = append(h.history, message)
-				if len(h.history) > MaxHistory {
-					// we are showing only latest 100.
-					h.history = h.history[len(h.history)-MaxHistory:]
+			if rm.msg.Type == ChatMessage {
+				if err := h.store.Append(rm.room, rm.msg); err != nil {
+					log.Println("history append error:", err)
 				}
 			}
 
-			for client := range h.clients {
-				client.send <- message
+			for client := range room.clients {
+				h.send(client, rm.msg)
+			}
+
+		// ── Private message routed directly to one recipient ──
+		case dm := <-h.direct:
+			envelope := Message{
+				Type:    DirectMessage,
+				Payload: map[string]string{"to": dm.to, "from": dm.from.name, "message": dm.text},
+			}
+
+			recipient, ok := h.byName[dm.to]
+			if !ok {
+				h.send(dm.from, Message{
+					Type:    System,
+					Payload: map[string]string{"text": dm.to + " is not connected"},
+				})
+				break
+			}
+
+			h.send(dm.from, envelope) // echo back to the sender
+			if recipient != dm.from {
+				h.send(recipient, envelope)
 			}
 		}
 	}
 }
 
-// broadcastUserCount sends a userCount frame to all connected clients.
-// Must be called from a goroutine (not directly inside hub.run's select).
-func (h *Hub) broadcastUserCount() {
-	h.broadcast <- Message{
-		Type:    UserCount,
-		Payload: map[string]int{"count": len(h.clients)},
+// send delivers msg to client without blocking the hub: if the client's
+// buffer is full, it is evicted instead of stalling every other client. A
+// client that was already evicted earlier in the same run loop (e.g. a
+// directMessage queued before its sender got kicked) is silently dropped
+// rather than sent on its now-closed channel. Must only be called from
+// Hub.run.
+func (h *Hub) send(client *Client, msg Message) {
+	if !h.clients[client] {
+		return
+	}
+	select {
+	case client.send <- msg:
+	default:
+		h.evict(client, "send buffer full")
+	}
+}
+
+// evict forcibly disconnects a client — because it can't keep up with
+// broadcasts, or because a newer connection for the same identity just took
+// over. It is dropped from every room, from byName, and its send channel is
+// closed (triggering writePump to exit), so a later, in-flight unregister is
+// a no-op. Must only be called from Hub.run.
+func (h *Hub) evict(client *Client, reason string) {
+	if !h.clients[client] {
+		return
+	}
+
+	// Reuse unsubscribe so evicted clients get the same per-room userCount
+	// and "left" announcement that a graceful disconnect produces.
+	for roomName := range client.rooms {
+		h.unsubscribe(client, roomName)
+	}
+	delete(h.clients, client)
+	if h.byName[client.name] == client {
+		delete(h.byName, client.name)
+	}
+	close(client.send)
+
+	log.Printf("hub: evicted client %q: %s", client.name, reason)
+}
+
+// broadcastUserCount sends a userCount frame carrying count to every
+// subscriber of roomName. count must be read from room.clients synchronously
+// by the caller, inside Hub.run — this function itself must be called from a
+// goroutine (not directly inside hub.run's select), so it must not touch
+// Hub/Room state itself.
+func (h *Hub) broadcastUserCount(roomName string, count int) {
+	h.broadcast <- roomMessage{
+		room: roomName,
+		msg: Message{
+			Type:    UserCount,
+			Payload: map[string]int{"count": count},
+		},
 	}
 }
 
-// broadcastSystem sends a server-generated system announcement to all clients.
+// broadcastSystem sends a server-generated system announcement to roomName.
 // Must be called from a goroutine (not directly inside hub.run's select).
-func (h *Hub) broadcastSystem(text string) {
-	h.broadcast <- Message{
-		Type:    System,
-		Payload: map[string]string{"text": text},
+func (h *Hub) broadcastSystem(roomName, text string) {
+	h.broadcast <- roomMessage{
+		room: roomName,
+		msg: Message{
+			Type:    System,
+			Payload: map[string]string{"text": text},
+		},
 	}
 }
 
-// readPump reads JSON frames from the WebSocket and forwards chat messages to
+// readPump reads JSON frames from the WebSocket and forwards them to
 // the hub. It exits (and triggers cleanup) on any read error, which covers:
 //   - Normal browser tab close / WebSocket close frame
 //   - Network drop
@@ -134,79 +496,221 @@ func (c *Client) readPump(h *Hub) {
 		c.conn.Close()
 	}()
 
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
 	for {
 		var msg Message
 		if err := c.conn.ReadJSON(&msg); err != nil {
 			break
 		}
 
-		if msg.Type == ChatMessage {
+		switch msg.Type {
+		case ChatMessage:
+			payload, ok := msg.Payload.(map[string]any)
+			if !ok {
+				continue
+			}
 			// Normalise the payload: replace whatever username the client sent
 			// with the server-resolved name (handles anon users and prevents
 			// clients from impersonating others by spoofing the username field).
-			if payload, ok := msg.Payload.(map[string]any); ok {
-				payload["username"] = c.name
-				msg.Payload = payload
+			payload["username"] = c.name
+			room, _ := payload["room"].(string)
+			if room == "" {
+				room = DefaultRoom
+			}
+			payload["room"] = room
+			msg.Payload = payload
+
+			h.broadcast <- roomMessage{room: room, msg: msg}
+
+		case Join:
+			if room := roomFromPayload(msg.Payload); room != "" {
+				h.join <- membership{client: c, room: room}
+			}
+
+		case Leave:
+			if room := roomFromPayload(msg.Payload); room != "" {
+				h.leave <- membership{client: c, room: room}
 			}
 
-			h.broadcast <- msg
+		case RoomList:
+			h.roomListReq <- c
+
+		case DirectMessage:
+			payload, ok := msg.Payload.(map[string]any)
+			if !ok {
+				continue
+			}
+			to, _ := payload["to"].(string)
+			text, _ := payload["message"].(string)
+			if to == "" {
+				continue
+			}
+			h.direct <- directMessage{from: c, to: to, text: text}
 		}
 	}
 }
 
+// roomFromPayload extracts the "room" field from a join/leave payload.
+func roomFromPayload(payload any) string {
+	m, ok := payload.(map[string]any)
+	if !ok {
+		return ""
+	}
+	room, _ := m["room"].(string)
+	return room
+}
+
 // writePump drains the client's send channel and serialises each Message to
 // the WebSocket as JSON. It exits when the channel is closed by hub.run,
 // which happens during unregister.
 func (c *Client) writePump() {
-	defer c.conn.Close()
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
 
-	for msg := range c.send {
-		if err := c.conn.WriteJSON(msg); err != nil {
-			log.Println("Write error:", err)
-			break
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel; tell the peer we're done.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := c.conn.WriteJSON(msg); err != nil {
+				log.Println("Write error:", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// loginRequest is the JSON body accepted by /login.
+type loginRequest struct {
+	Username string `json:"username"`
+}
+
+// loginHandler issues a one-time token bound to the requested username (or
+// an anonymous one, if none was given). The token must be presented as
+// ?token= on the subsequent /chat upgrade, and is consumed on first use.
+func loginHandler(store *TokenStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req loginRequest
+		_ = c.ShouldBindJSON(&req) // no/empty body is fine; we fall back to an anon name
+
+		username := strings.TrimSpace(req.Username)
+		if username == "" {
+			username = anonName()
 		}
+
+		token, err := store.Issue(username)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"token": token, "username": username})
 	}
 }
 
-// serveChat upgrades an HTTP GET /chat request to a WebSocket, resolves the
-// username, and wires up the client to the hub.
-func serveChat(hub *Hub, c *gin.Context) {
+// serveChat upgrades an HTTP GET /chat request to a WebSocket. It requires a
+// valid, single-use ?token= issued by /login: the resolved username always
+// comes from the token, never from the client, and the request is rejected
+// with 401 before the upgrade if the token is missing, unknown, or expired.
+// An optional ?limit= overrides how much history is replayed on join
+// (default MaxHistory).
+func serveChat(hub *Hub, store *TokenStore, upgrader *websocket.Upgrader, cfg ServerConfig, c *gin.Context) {
+	token := strings.TrimSpace(c.Query("token"))
+	if token == "" {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	username, ok := store.Consume(token)
+	if !ok {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Println("Upgrade error:", err)
 		return
 	}
 
-	username := strings.TrimSpace(c.Query("username"))
-	if username == "" {
-		var sb strings.Builder
-		sb.WriteString("Anon_")
-		sb.WriteString(time.Now().Format(DateFormat))
-		username = sb.String()
+	if cfg.EnableCompression {
+		conn.EnableWriteCompression(true)
+		conn.SetCompressionLevel(flate.BestSpeed)
+	}
+
+	room := strings.TrimSpace(c.Query("room"))
+	if room == "" {
+		room = DefaultRoom
+	}
+
+	limit := 0 // 0 means "use the hub's default", see Hub.subscribe
+	if raw := c.Query("limit"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			if n > MaxHistoryLimit {
+				n = MaxHistoryLimit
+			}
+			limit = n
+		}
 	}
 
 	client := &Client{
-		conn: conn,
-		send: make(chan Message, 256), // buffered to absorb bursts without stalling hub.run ; incase those guys wanna spam
-		name: username,
+		conn:  conn,
+		send:  make(chan Message, 256), // buffered to absorb bursts without stalling hub.run ; incase those guys wanna spam
+		name:  username,
+		rooms: make(map[string]bool),
 	}
 
-	hub.register <- client
+	hub.register <- membership{client: client, room: room, limit: limit}
 
 	go client.writePump()
 	go client.readPump(hub)
 }
 
 func main() {
-	hub := newHub()
+	cfg := loadConfig()
+	upgrader := newUpgrader(cfg)
+
+	store, err := newHistoryStore(cfg)
+	if err != nil {
+		log.Fatal("opening history store:", err)
+	}
+	if closer, ok := store.(interface{ Close() error }); ok {
+		defer closer.Close()
+	}
+
+	hub := newHub(store)
 	go hub.run()
 
+	tokens := newTokenStore()
+
 	r := gin.Default()
 
+	r.POST("/login", loginHandler(tokens))
+
 	r.GET("/chat", func(c *gin.Context) {
-		serveChat(hub, c)
+		serveChat(hub, tokens, &upgrader, cfg, c)
 	})
 
-	log.Println("Hallway Server running on :8080")
-	r.Run(":8080")
+	log.Println("Hallway Server running on", cfg.Addr)
+	r.Run(cfg.Addr)
 }